@@ -0,0 +1,1010 @@
+// Package continuous_querier provides a service and API for continuous queries.
+package continuous_querier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/toml"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// NoChunkingSize specifies when not to chunk results. When planning
+	// a query, if output buffering is disabled, `MaxChunkSize` is
+	// initialized to this value, signaling to the engine not to chunk results.
+	NoChunkingSize = 0
+
+	// DefaultRunInterval is the default interval for how often the CQ
+	// service gets run.
+	DefaultRunInterval = time.Second
+
+	// DefaultCheckpointInterval is the default interval at which an
+	// in-flight continuous query execution persists a checkpoint of its
+	// progress, following the "write resume span every N seconds if
+	// enough time has elapsed" pattern used elsewhere in the server.
+	DefaultCheckpointInterval = 30 * time.Second
+
+	// BackpressureBlock makes ExecuteContinuousQuery wait for budget to
+	// become available when the service is over its configured limits.
+	BackpressureBlock = "block"
+
+	// BackpressureShed makes ExecuteContinuousQuery skip a window's query
+	// (counted in the queriesSkipped statistic) instead of waiting for a
+	// MaxConcurrentQueries slot. MaxPointsPerSecond throttling still waits.
+	BackpressureShed = "shed"
+
+	// statsCQ is the name under which CQ service statistics are reported.
+	statsCQ = "cq"
+)
+
+// ContinuousQuerier represents a service that executes continuous queries.
+type ContinuousQuerier interface {
+	// Run executes the named query in the named database.  Blank database or name matches all.
+	Run(database, name string, t time.Time) error
+}
+
+// RunRequest is a request to run one or more CQs.
+type RunRequest struct {
+	// Now tells the CQ service what the current time is.
+	Now time.Time
+
+	// CQ restricts execution to the continuous query with this name. A
+	// blank name matches every CQ.
+	CQ string
+
+	// Database restricts execution to CQs belonging to this database. A
+	// blank name matches every database.
+	Database string
+}
+
+// matches returns true if the RunRequest indicates that the given database
+// and CQ combination should be run.
+func (rr *RunRequest) matches(database, name string) bool {
+	if rr.Database != "" && rr.Database != database {
+		return false
+	}
+	if rr.CQ != "" && rr.CQ != name {
+		return false
+	}
+	return true
+}
+
+// CQState records the progress of a continuous query's execution so it can
+// be resumed after a restart instead of silently dropping in-flight work.
+type CQState struct {
+	// LastRun is the time that was passed to the execution of the CQ that
+	// saved this checkpoint, whether or not that execution has completed.
+	LastRun time.Time
+
+	// WindowStart and WindowEnd bound the resample window that is currently
+	// (or was most recently) being processed.
+	WindowStart time.Time
+	WindowEnd   time.Time
+
+	// Complete is true once the window's WritePoints has been acknowledged
+	// as successful.
+	Complete bool
+
+	// Attempt counts how many times this specific window has been issued,
+	// starting at 1. It is incremented when a checkpoint is loaded for a
+	// window that matches the one about to run, so a resumed run can tell
+	// it is reprocessing rather than starting fresh.
+	Attempt int
+}
+
+// EventKind identifies a point in a continuous query's lifecycle that
+// external code can subscribe to via Service.Subscribe.
+type EventKind int
+
+const (
+	// BeforeRun fires just before a CQ's windows are about to be executed.
+	BeforeRun EventKind = iota
+
+	// AfterRun fires once all of a CQ's windows have executed successfully.
+	AfterRun
+
+	// OnError fires when executing a CQ's window returns an error.
+	OnError
+
+	// OnSkip fires when a CQ is not executed because this node isn't the
+	// CQ's lease holder or the meta store is unreachable. Runs skipped because
+	// their anchor has already run, and windows shed by backpressure, do not
+	// fire it.
+	OnSkip
+
+	// OnWrite fires after each window of a CQ executes successfully, carrying
+	// the number of points it wrote, which may be zero.
+	OnWrite
+)
+
+// SkipReason explains why an OnSkip event fired.
+type SkipReason int
+
+const (
+	// SkipNotLeader means this node is not the cluster leader.
+	SkipNotLeader SkipReason = iota
+
+	// SkipLeaseLost means another node currently holds the CQ's lease.
+	SkipLeaseLost
+
+	// SkipMetaError means the meta store could not be queried.
+	SkipMetaError
+)
+
+// CQEvent describes a single continuous query lifecycle event, delivered to
+// subscribers registered via Service.Subscribe.
+type CQEvent struct {
+	Database string
+	Name     string
+
+	Now         time.Time
+	WindowStart time.Time
+	WindowEnd   time.Time
+
+	Err           error
+	PointsWritten int64
+	SkipReason    SkipReason
+}
+
+// hookSubscription is one Subscribe registration.
+type hookSubscription struct {
+	id uint64
+	fn func(CQEvent)
+}
+
+// Checkpointer persists and retrieves the execution progress of continuous
+// queries. Implementations must be safe to call from multiple goroutines.
+type Checkpointer interface {
+	// Save persists state as the current checkpoint for the db/cq pair.
+	Save(db, cqName string, state CQState) error
+
+	// Load returns the last checkpoint saved for the db/cq pair. It
+	// returns the zero CQState, with no error, if nothing has been saved.
+	Load(db, cqName string) (CQState, error)
+}
+
+// fileCheckpointer is the default Checkpointer. It stores one JSON file per
+// continuous query underneath a "continuous_queries" directory in the
+// server's meta dir.
+type fileCheckpointer struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileCheckpointer returns a Checkpointer that persists CQState as JSON
+// files under dir/continuous_queries.
+func NewFileCheckpointer(dir string) Checkpointer {
+	return &fileCheckpointer{path: filepath.Join(dir, "continuous_queries")}
+}
+
+func (c *fileCheckpointer) filename(db, cqName string) string {
+	return filepath.Join(c.path, fmt.Sprintf("%s_%s.json", db, cqName))
+}
+
+// Save implements Checkpointer. Writing to a temp file and renaming it into
+// place keeps a checkpoint from ever being observed half-written.
+func (c *fileCheckpointer) Save(db, cqName string, state CQState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(c.path, 0777); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.filename(db, cqName) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.filename(db, cqName))
+}
+
+// Load implements Checkpointer.
+func (c *fileCheckpointer) Load(db, cqName string) (CQState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := ioutil.ReadFile(c.filename(db, cqName))
+	if os.IsNotExist(err) {
+		return CQState{}, nil
+	} else if err != nil {
+		return CQState{}, err
+	}
+
+	var state CQState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return CQState{}, err
+	}
+	return state, nil
+}
+
+// Config represents a configuration for the continuous query service.
+type Config struct {
+	// Enabled controls whether the continuous query service runs on this
+	// node at all.
+	Enabled bool `toml:"enabled"`
+
+	// LogEnabled controls whether successful CQ runs are logged. Errors and
+	// warnings are always logged regardless of this setting.
+	LogEnabled bool `toml:"log-enabled"`
+
+	// LogLevel is the minimum zap level emitted by the service's logger:
+	// one of "debug", "info", "warn", or "error".
+	LogLevel string `toml:"log-level"`
+
+	// LogSampling configures zap's log sampling so that a CQ which errors
+	// on every run doesn't flood the log at high RunInterval frequencies.
+	LogSampling LogSamplingConfig `toml:"log-sampling"`
+
+	// RunInterval is how often the CQ service checks for CQs that are due
+	// to run.
+	RunInterval toml.Duration `toml:"run-interval"`
+
+	// CheckpointInterval is how often an in-flight CQ execution persists a
+	// checkpoint of its progress via the configured Checkpointer.
+	CheckpointInterval toml.Duration `toml:"checkpoint-interval"`
+
+	// MaxPointsPerSecond caps the aggregate rate, across all CQs, at which
+	// points written by a CQ's INTO clause are allowed to complete. Zero
+	// disables the limit.
+	MaxPointsPerSecond int `toml:"max-points-per-second"`
+
+	// MaxConcurrentQueries bounds how many CQ executions may be in flight
+	// at once. Zero disables the limit.
+	MaxConcurrentQueries int `toml:"max-concurrent-queries"`
+
+	// QueryTimeout bounds how long a single CQ execution may run before
+	// its query is cancelled. Zero disables the timeout.
+	QueryTimeout toml.Duration `toml:"query-timeout"`
+
+	// BackpressurePolicy is either BackpressureBlock or BackpressureShed,
+	// and controls what happens when a CQ would exceed MaxConcurrentQueries.
+	BackpressurePolicy string `toml:"backpressure-policy"`
+}
+
+// LogSamplingConfig mirrors zap.SamplingConfig so it can be expressed in
+// TOML: Initial log lines per second are emitted as-is, and every
+// Thereafter'th line after that is emitted, the rest are dropped.
+type LogSamplingConfig struct {
+	Initial    int `toml:"initial"`
+	Thereafter int `toml:"thereafter"`
+}
+
+// NewConfig returns a new Config with default settings.
+func NewConfig() Config {
+	return Config{
+		Enabled:            true,
+		LogEnabled:         true,
+		LogLevel:           "info",
+		LogSampling:        LogSamplingConfig{Initial: 100, Thereafter: 100},
+		RunInterval:        toml.Duration(DefaultRunInterval),
+		CheckpointInterval: toml.Duration(DefaultCheckpointInterval),
+		BackpressurePolicy: BackpressureBlock,
+	}
+}
+
+// NewLogger returns the *zap.Logger a Service should use given c's
+// LogLevel and LogSampling settings, writing to stderr.
+func NewLogger(c Config) *zap.Logger {
+	level := zapcore.InfoLevel
+	level.Set(c.LogLevel)
+
+	encoderCfg := zap.NewProductionEncoderConfig()
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), zapcore.Lock(os.Stderr), level)
+	if c.LogSampling.Initial > 0 {
+		core = zapcore.NewSampler(core, time.Second, c.LogSampling.Initial, c.LogSampling.Thereafter)
+	}
+	return zap.New(core).Named("continuous_querier")
+}
+
+// cqStatistics holds the atomic counters backing Service.Statistics.
+type cqStatistics struct {
+	queriesExecuted    int64
+	queriesSkipped     int64
+	pointsWrittenTotal int64
+	writeWaitNs        int64
+}
+
+// Service manages continuous query execution.
+type Service struct {
+	MetaClient interface {
+		AcquireLease(name string) (l *meta.Lease, err error)
+		Databases() ([]meta.DatabaseInfo, error)
+		Database(name string) (*meta.DatabaseInfo, error)
+		NodeID() uint64
+	}
+
+	QueryExecutor interface {
+		ExecuteQuery(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error)
+	}
+
+	// Checkpointer persists CQ execution progress so it can be resumed on
+	// restart. A nil Checkpointer disables checkpointing.
+	Checkpointer Checkpointer
+
+	Config             *Config
+	RunInterval        time.Duration
+	CheckpointInterval time.Duration
+	RunCh              chan *RunRequest
+	Logger             *zap.Logger
+	loggingEnabled     bool
+
+	// limiter bounds the aggregate rate of points written by CQ INTO
+	// clauses. Nil when Config.MaxPointsPerSecond is zero.
+	limiter *rate.Limiter
+
+	// sem bounds the number of concurrent ExecuteContinuousQuery calls.
+	// Nil when Config.MaxConcurrentQueries is zero.
+	sem *semaphore.Weighted
+
+	queryTimeout time.Duration
+	backpressure string
+	stats        cqStatistics
+
+	mu             sync.Mutex
+	lastRuns       map[string]time.Time // keyed by "db/cq", holds the last executed window anchor
+	lastCheckpoint map[string]time.Time // keyed by "db/cq", holds when a checkpoint was last saved
+
+	hooksMu    sync.RWMutex
+	hooks      map[EventKind][]*hookSubscription
+	nextHookID uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewService returns a new instance of Service.
+func NewService(c Config) *Service {
+	s := &Service{
+		Config:             &c,
+		RunInterval:        time.Duration(c.RunInterval),
+		CheckpointInterval: time.Duration(c.CheckpointInterval),
+		RunCh:              make(chan *RunRequest),
+		Logger:             NewLogger(c),
+		loggingEnabled:     c.LogEnabled,
+		lastRuns:           make(map[string]time.Time),
+		lastCheckpoint:     make(map[string]time.Time),
+		queryTimeout:       time.Duration(c.QueryTimeout),
+		backpressure:       c.BackpressurePolicy,
+	}
+
+	if s.backpressure == "" {
+		s.backpressure = BackpressureBlock
+	}
+	if c.MaxPointsPerSecond > 0 {
+		s.limiter = rate.NewLimiter(rate.Limit(c.MaxPointsPerSecond), c.MaxPointsPerSecond)
+	}
+	if c.MaxConcurrentQueries > 0 {
+		s.sem = semaphore.NewWeighted(int64(c.MaxConcurrentQueries))
+	}
+
+	return s
+}
+
+// Subscribe registers fn to be called with a CQEvent each time an event of
+// the given kind fires. The returned unsubscribe func removes fn; it is
+// safe to call more than once and from any goroutine.
+func (s *Service) Subscribe(kind EventKind, fn func(CQEvent)) (unsubscribe func()) {
+	s.hooksMu.Lock()
+	if s.hooks == nil {
+		s.hooks = make(map[EventKind][]*hookSubscription)
+	}
+	s.nextHookID++
+	sub := &hookSubscription{id: s.nextHookID, fn: fn}
+	s.hooks[kind] = append(s.hooks[kind], sub)
+	s.hooksMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.hooksMu.Lock()
+			defer s.hooksMu.Unlock()
+			subs := s.hooks[kind]
+			for i, existing := range subs {
+				if existing.id == sub.id {
+					s.hooks[kind] = append(subs[:i], subs[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+}
+
+// fire delivers ev to every subscriber of kind. Subscribers are snapshotted
+// under lock and then called without it held, so a hook may safely call
+// Subscribe or unsubscribe itself.
+func (s *Service) fire(kind EventKind, ev CQEvent) {
+	s.hooksMu.RLock()
+	subs := s.hooks[kind]
+	fns := make([]func(CQEvent), len(subs))
+	for i, sub := range subs {
+		fns[i] = sub.fn
+	}
+	s.hooksMu.RUnlock()
+
+	for _, fn := range fns {
+		fn(ev)
+	}
+}
+
+// Statistics returns statistics for periodic monitoring.
+func (s *Service) Statistics(tags map[string]string) []models.Statistic {
+	return []models.Statistic{{
+		Name: statsCQ,
+		Tags: tags,
+		Values: map[string]interface{}{
+			"queriesExecuted":    atomic.LoadInt64(&s.stats.queriesExecuted),
+			"queriesSkipped":     atomic.LoadInt64(&s.stats.queriesSkipped),
+			"pointsWrittenTotal": atomic.LoadInt64(&s.stats.pointsWrittenTotal),
+			"writeWaitNs":        atomic.LoadInt64(&s.stats.writeWaitNs),
+		},
+	}}
+}
+
+// Open starts the background loop that executes continuous queries.
+func (s *Service) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.Config.Enabled {
+		return nil
+	}
+	if s.done != nil {
+		return nil
+	}
+
+	assert(s.MetaClient != nil, "continuous querier service: MetaClient is nil")
+	assert(s.QueryExecutor != nil, "continuous querier service: QueryExecutor is nil")
+
+	s.Logger.Info("Starting continuous query service")
+
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go s.backgroundLoop()
+	return nil
+}
+
+// Close stops the background loop that executes continuous queries.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	done := s.done
+	s.done = nil
+	s.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+	close(done)
+	s.wg.Wait()
+	return nil
+}
+
+// Run runs the specified continuous query, or all continuous queries if
+// name is blank, for the database, or all databases if database is blank,
+// as of "now".
+func (s *Service) Run(database, name string, now time.Time) error {
+	req := &RunRequest{Now: now, CQ: name, Database: database}
+
+	// Forget when the matching CQs last ran, so they execute as of now even
+	// if an earlier run already covered the same or a later anchor.
+	s.mu.Lock()
+	for key := range s.lastRuns {
+		if i := strings.Index(key, "/"); i >= 0 && req.matches(key[:i], key[i+1:]) {
+			delete(s.lastRuns, key)
+		}
+	}
+	s.mu.Unlock()
+
+	s.RunCh <- req
+	return nil
+}
+
+// backgroundLoop is the main loop used to periodically run continuous
+// queries, and to service requests sent on s.RunCh.
+func (s *Service) backgroundLoop() {
+	defer s.wg.Done()
+
+	s.resume()
+
+	interval := s.RunInterval
+	if interval <= 0 {
+		interval = DefaultRunInterval
+	}
+	t := time.NewTimer(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case req := <-s.RunCh:
+			s.runContinuousQueries(req)
+		case <-t.C:
+			s.runContinuousQueries(&RunRequest{Now: time.Now()})
+			t.Reset(interval)
+		}
+	}
+}
+
+// resume walks every CQ the meta store knows about and re-issues the single
+// window whose checkpoint was saved but never marked complete, so a restart
+// never silently drops in-flight resampling work. Exactly like
+// runContinuousQueries, it acquires the CQ's lease before touching it, so a
+// node that isn't (or is no longer) the lease holder doesn't replay and
+// checkpoint work that belongs to whichever node is.
+func (s *Service) resume() {
+	if s.Checkpointer == nil {
+		return
+	}
+
+	dbs, err := s.MetaClient.Databases()
+	if err != nil {
+		s.Logger.Error("failed to resume continuous queries", zap.Error(err))
+		return
+	}
+
+	for _, db := range dbs {
+		for i := range db.ContinuousQueries {
+			cqi := db.ContinuousQueries[i]
+			state, err := s.Checkpointer.Load(db.Name, cqi.Name)
+			if err != nil {
+				s.Logger.Error("failed to load checkpoint",
+					zap.String("database", db.Name), zap.String("cq_name", cqi.Name), zap.Error(err))
+				continue
+			}
+			if state.Complete || state.WindowEnd.IsZero() {
+				continue
+			}
+
+			dbi, cqInfo := db, cqi
+			if _, err := s.MetaClient.AcquireLease(leaseName(dbi.Name, cqInfo.Name)); err != nil {
+				reason := SkipLeaseLost
+				if err == meta.ErrServiceUnavailable {
+					reason = SkipNotLeader
+				}
+				s.fire(OnSkip, CQEvent{Database: dbi.Name, Name: cqInfo.Name, Now: state.WindowEnd, Err: err, SkipReason: reason})
+				continue
+			}
+
+			if err := s.resumeWindow(&dbi, &cqInfo, state); err != nil {
+				s.Logger.Error("failed to resume continuous query",
+					zap.String("database", dbi.Name), zap.String("cq_name", cqInfo.Name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// resumeWindow re-executes the single window recorded in state. It
+// deliberately does not call ExecuteContinuousQuery: that would truncate
+// state.WindowEnd back into its RESAMPLE EVERY anchor and replay the whole
+// RESAMPLE FOR range for that anchor, re-issuing earlier windows whose
+// WritePoints had already been acknowledged as successful before the
+// checkpoint for this window was written.
+func (s *Service) resumeWindow(dbi *meta.DatabaseInfo, cqi *meta.ContinuousQueryInfo, state CQState) error {
+	cq, err := NewContinuousQuery(dbi.Name, cqi)
+	if err != nil {
+		return err
+	}
+
+	logger := s.Logger.With(
+		zap.String("database", dbi.Name),
+		zap.String("cq_name", cqi.Name),
+		zap.Time("now", state.WindowEnd),
+		zap.Duration("resample_every", cq.Resample.Every),
+		zap.Duration("resample_for", cq.Resample.For),
+	)
+	logEnabled := s.cqLogEnabled(dbi.Name, cqi.Name)
+
+	s.fire(BeforeRun, CQEvent{Database: dbi.Name, Name: cqi.Name, Now: state.WindowEnd})
+	executed, err := s.runCQWindow(cq, dbi, cqi, state.WindowEnd, state.WindowStart, state.WindowEnd, logger, logEnabled)
+	if err != nil {
+		return err
+	}
+	if executed {
+		s.fire(AfterRun, CQEvent{Database: dbi.Name, Name: cqi.Name, Now: state.WindowEnd})
+	}
+	return nil
+}
+
+// runContinuousQueries runs any continuous queries matching the request.
+// Matching CQs are run concurrently (each still serialized against the rest
+// of the cluster by its own lease), so Config.MaxConcurrentQueries and
+// Config.BackpressurePolicy have real concurrency to bound instead of being
+// inert against a single-threaded caller.
+func (s *Service) runContinuousQueries(req *RunRequest) {
+	dbs, err := s.MetaClient.Databases()
+	if err != nil {
+		s.Logger.Error("unable to get databases", zap.Error(err))
+		s.fire(OnSkip, CQEvent{Now: req.Now, Err: err, SkipReason: SkipMetaError})
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, db := range dbs {
+		for i := range db.ContinuousQueries {
+			cqi := db.ContinuousQueries[i]
+			if !req.matches(db.Name, cqi.Name) {
+				continue
+			}
+
+			dbi, cqInfo := db, cqi
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// Only the current lease holder for this CQ may execute (and
+				// therefore checkpoint) it.
+				if _, err := s.MetaClient.AcquireLease(leaseName(dbi.Name, cqInfo.Name)); err != nil {
+					reason := SkipLeaseLost
+					if err == meta.ErrServiceUnavailable {
+						reason = SkipNotLeader
+					}
+					s.fire(OnSkip, CQEvent{Database: dbi.Name, Name: cqInfo.Name, Now: req.Now, Err: err, SkipReason: reason})
+					return
+				}
+
+				if err := s.ExecuteContinuousQuery(&dbi, &cqInfo, req.Now); err != nil {
+					s.Logger.Error("error executing continuous query",
+						zap.String("database", dbi.Name), zap.String("cq_name", cqInfo.Name), zap.Error(err))
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// leaseName returns the meta lease name used to serialize execution of a
+// single continuous query across the cluster.
+func leaseName(db, cq string) string {
+	return fmt.Sprintf("cq:%s:%s", db, cq)
+}
+
+// ExecuteContinuousQuery executes a single continuous query for the given
+// database, as of "now".
+func (s *Service) ExecuteContinuousQuery(dbi *meta.DatabaseInfo, cqi *meta.ContinuousQueryInfo, now time.Time) error {
+	cq, err := NewContinuousQuery(dbi.Name, cqi)
+	if err != nil {
+		return err
+	}
+
+	key := dbi.Name + "/" + cqi.Name
+	anchor := now.Truncate(cq.Resample.Every)
+
+	s.mu.Lock()
+	lastAnchor, ok := s.lastRuns[key]
+	if ok && !anchor.After(lastAnchor) {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastRuns[key] = anchor
+	s.mu.Unlock()
+
+	groupByInterval, err := cq.Query.Source.GroupByInterval()
+	if err != nil {
+		return err
+	}
+	if groupByInterval <= 0 {
+		return errors.New("continuous queries must have a GROUP BY time interval")
+	}
+
+	windows := int(cq.Resample.For / groupByInterval)
+	if windows < 1 {
+		windows = 1
+	}
+
+	logger := s.Logger.With(
+		zap.String("database", dbi.Name),
+		zap.String("cq_name", cqi.Name),
+		zap.Time("now", now),
+		zap.Duration("resample_every", cq.Resample.Every),
+		zap.Duration("resample_for", cq.Resample.For),
+	)
+	logEnabled := s.cqLogEnabled(dbi.Name, cqi.Name)
+
+	s.fire(BeforeRun, CQEvent{Database: dbi.Name, Name: cqi.Name, Now: now})
+
+	allExecuted := true
+	for i := windows; i >= 1; i-- {
+		windowEnd := anchor.Add(-time.Duration(i-1) * groupByInterval)
+		windowStart := windowEnd.Add(-groupByInterval)
+
+		executed, err := s.runCQWindow(cq, dbi, cqi, now, windowStart, windowEnd, logger, logEnabled)
+		if err != nil {
+			return err
+		}
+		if !executed {
+			allExecuted = false
+		}
+	}
+
+	// AfterRun promises that all of a CQ's windows have executed
+	// successfully; if any window was shed by backpressure, that did not
+	// happen, so subscribers waiting for a run to complete are not told it did.
+	if allExecuted {
+		s.fire(AfterRun, CQEvent{Database: dbi.Name, Name: cqi.Name, Now: now})
+	}
+	return nil
+}
+
+// runCQWindow checkpoints and executes a single resample window, firing
+// OnError or OnWrite as appropriate. The pre-execution checkpoint is only
+// written once per Service.checkpointInterval for a given CQ, tracked in
+// s.lastCheckpoint so the interval is honored across calls rather than
+// resetting every time a run starts. It returns whether the window actually
+// executed, which is false (with a nil error) when the window was shed due
+// to backpressure.
+func (s *Service) runCQWindow(cq *ContinuousQuery, dbi *meta.DatabaseInfo, cqi *meta.ContinuousQueryInfo, now, windowStart, windowEnd time.Time, logger *zap.Logger, logEnabled bool) (executed bool, err error) {
+	attempt := 1
+	if s.Checkpointer != nil {
+		if prev, err := s.Checkpointer.Load(dbi.Name, cqi.Name); err == nil &&
+			prev.WindowStart.Equal(windowStart) && prev.WindowEnd.Equal(windowEnd) {
+			attempt = prev.Attempt + 1
+		}
+
+		if s.checkpointDue(dbi.Name, cqi.Name) {
+			state := CQState{LastRun: now, WindowStart: windowStart, WindowEnd: windowEnd, Attempt: attempt}
+			if err := s.Checkpointer.Save(dbi.Name, cqi.Name, state); err != nil {
+				logger.Error("failed to checkpoint continuous query", zap.Error(err))
+			}
+		}
+	}
+
+	start := time.Now()
+	pointsWritten, rerr := s.runWindow(cq, dbi.Name, windowStart, windowEnd)
+	if rerr == errQuerySkipped {
+		// Warnings are always logged regardless of Config.LogEnabled, unlike
+		// the "finished continuous query" info log below.
+		logger.Warn("skipped continuous query due to backpressure",
+			zap.Time("window_start", windowStart), zap.Time("window_end", windowEnd))
+		return false, nil
+	}
+
+	duration := time.Since(start)
+	windowLogger := logger.With(
+		zap.Time("window_start", windowStart),
+		zap.Time("window_end", windowEnd),
+		zap.Int64("points_written", pointsWritten),
+		zap.Int64("duration_ms", duration.Nanoseconds()/int64(time.Millisecond)),
+	)
+	if rerr != nil {
+		windowLogger.Error("continuous query execution failed", zap.Error(rerr))
+		s.fire(OnError, CQEvent{
+			Database: dbi.Name, Name: cqi.Name, Now: now,
+			WindowStart: windowStart, WindowEnd: windowEnd, Err: rerr,
+		})
+		return true, rerr
+	}
+	if logEnabled {
+		windowLogger.Info("finished continuous query")
+	}
+	s.fire(OnWrite, CQEvent{
+		Database: dbi.Name, Name: cqi.Name, Now: now,
+		WindowStart: windowStart, WindowEnd: windowEnd, PointsWritten: pointsWritten,
+	})
+
+	if s.Checkpointer != nil {
+		state := CQState{LastRun: now, WindowStart: windowStart, WindowEnd: windowEnd, Complete: true, Attempt: attempt}
+		if err := s.Checkpointer.Save(dbi.Name, cqi.Name, state); err != nil {
+			windowLogger.Error("failed to checkpoint continuous query", zap.Error(err))
+		}
+	}
+	return true, nil
+}
+
+// cqLogEnabled reports whether successful runs of the named CQ should be
+// logged. It defers to a per-CQ override read from the meta store when the
+// configured MetaClient supports one, and otherwise falls back to the
+// service-wide Config.LogEnabled setting.
+func (s *Service) cqLogEnabled(db, cqName string) bool {
+	type cqLogOverrider interface {
+		ContinuousQueryLogEnabled(db, cqName string) (bool, error)
+	}
+	if mc, ok := s.MetaClient.(cqLogOverrider); ok {
+		if enabled, err := mc.ContinuousQueryLogEnabled(db, cqName); err == nil {
+			return enabled
+		}
+	}
+	return s.loggingEnabled
+}
+
+// checkpointInterval returns the effective checkpoint interval, falling
+// back to DefaultCheckpointInterval when unset.
+func (s *Service) checkpointInterval() time.Duration {
+	if s.CheckpointInterval > 0 {
+		return s.CheckpointInterval
+	}
+	return DefaultCheckpointInterval
+}
+
+// checkpointDue reports whether it has been at least checkpointInterval
+// since a checkpoint was last saved for db/cqName, and if so records that
+// one is being saved now. Tracking this on the Service rather than per call
+// is what lets the interval span multiple runs of the same CQ instead of
+// resetting to "always due" every time ExecuteContinuousQuery is called.
+func (s *Service) checkpointDue(db, cqName string) bool {
+	key := db + "/" + cqName
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.lastCheckpoint[key]) < s.checkpointInterval() {
+		return false
+	}
+	s.lastCheckpoint[key] = time.Now()
+	return true
+}
+
+// errQuerySkipped is returned by runWindow when BackpressureShed is
+// configured and the concurrency budget is exhausted.
+var errQuerySkipped = errors.New("continuous query skipped: over concurrency budget")
+
+// runWindow executes the CQ's query for a single resample window and waits
+// for the query (and the write it triggers via its INTO clause) to finish.
+// It returns the number of points the INTO clause wrote.
+//
+// Execution is bounded by Config.MaxConcurrentQueries and Config.QueryTimeout,
+// and the rate at which it returns is throttled to Config.MaxPointsPerSecond.
+func (s *Service) runWindow(cq *ContinuousQuery, database string, start, end time.Time) (int64, error) {
+	if s.sem != nil {
+		if s.backpressure == BackpressureShed {
+			if !s.sem.TryAcquire(1) {
+				atomic.AddInt64(&s.stats.queriesSkipped, 1)
+				return 0, errQuerySkipped
+			}
+		} else if err := s.sem.Acquire(context.Background(), 1); err != nil {
+			return 0, err
+		}
+		defer s.sem.Release(1)
+	}
+
+	closing := make(chan struct{})
+	var closeOnce sync.Once
+	closeFn := func() { closeOnce.Do(func() { close(closing) }) }
+	defer closeFn()
+
+	if s.queryTimeout > 0 {
+		timer := time.AfterFunc(s.queryTimeout, closeFn)
+		defer timer.Stop()
+	}
+
+	q, err := cq.query(start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	ch, err := s.QueryExecutor.ExecuteQuery(q, database, NoChunkingSize, closing)
+	if err != nil {
+		return 0, err
+	}
+
+	var pointsWritten int64
+	for result := range ch {
+		if result.Err != nil {
+			return pointsWritten, result.Err
+		}
+		for _, row := range result.Series {
+			pointsWritten += int64(len(row.Values))
+		}
+	}
+
+	atomic.AddInt64(&s.stats.queriesExecuted, 1)
+	atomic.AddInt64(&s.stats.pointsWrittenTotal, pointsWritten)
+
+	if s.limiter != nil && pointsWritten > 0 {
+		waitStart := time.Now()
+		// WaitN errors if asked to wait for more than the limiter's burst in
+		// one call, which an aggregating CQ writing more than
+		// MaxPointsPerSecond in a single window would otherwise hit on every
+		// run. Chunk the wait into burst-sized steps instead.
+		burst := int64(s.limiter.Burst())
+		for remaining := pointsWritten; remaining > 0; {
+			n := remaining
+			if burst > 0 && n > burst {
+				n = burst
+			}
+			if err := s.limiter.WaitN(context.Background(), int(n)); err != nil {
+				return pointsWritten, err
+			}
+			remaining -= n
+		}
+		atomic.AddInt64(&s.stats.writeWaitNs, int64(time.Since(waitStart)))
+	}
+
+	return pointsWritten, nil
+}
+
+// ResampleOptions holds the effective RESAMPLE EVERY/FOR durations for a
+// continuous query.
+type ResampleOptions struct {
+	Every time.Duration
+	For   time.Duration
+}
+
+// ContinuousQuery is a local wrapper around a parsed CREATE CONTINUOUS QUERY
+// statement plus its effective resample options.
+type ContinuousQuery struct {
+	Database string
+	Info     *meta.ContinuousQueryInfo
+	Query    *influxql.CreateContinuousQueryStatement
+	Resample ResampleOptions
+}
+
+// NewContinuousQuery returns a ContinuousQuery parsed from the given meta
+// info, with its resample options resolved against the query's own GROUP BY
+// time interval.
+func NewContinuousQuery(database string, cqi *meta.ContinuousQueryInfo) (*ContinuousQuery, error) {
+	parsed, err := influxql.ParseStatement(cqi.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, ok := parsed.(*influxql.CreateContinuousQueryStatement)
+	if !ok {
+		return nil, fmt.Errorf("query %q is not a CREATE CONTINUOUS QUERY statement", cqi.Query)
+	}
+	if stmt.Source == nil {
+		return nil, errors.New("continuous query is missing a SELECT statement")
+	}
+
+	interval, err := stmt.Source.GroupByInterval()
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, errors.New("continuous queries must have a GROUP BY time interval")
+	}
+
+	every := interval
+	if stmt.ResampleEvery > 0 {
+		every = stmt.ResampleEvery
+	}
+	forDuration := every
+	if stmt.ResampleFor > 0 {
+		forDuration = stmt.ResampleFor
+	}
+
+	return &ContinuousQuery{
+		Database: database,
+		Info:     cqi,
+		Query:    stmt,
+		Resample: ResampleOptions{Every: every, For: forDuration},
+	}, nil
+}
+
+// query returns the SELECT statement to run for the window [start, end),
+// rewritten with an explicit time bound.
+func (cq *ContinuousQuery) query(start, end time.Time) (*influxql.Query, error) {
+	stmt := cq.Query.Source.Clone()
+	if err := stmt.SetTimeRange(start, end); err != nil {
+		return nil, err
+	}
+	return &influxql.Query{Statements: influxql.Statements{stmt}}, nil
+}
+
+// assert will panic with a given formatted message if the given condition
+// is false.
+func assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assert failed: "+msg, v...))
+	}
+}
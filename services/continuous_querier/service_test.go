@@ -1,11 +1,13 @@
 package continuous_querier
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,8 +15,19 @@ import (
 	"github.com/influxdata/influxdb/influxql"
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/services/meta"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// NewTestLogger returns a *zap.Logger that writes JSON lines to buf, so
+// tests can assert on structured fields instead of matching stdout
+// substrings.
+func NewTestLogger(buf *bytes.Buffer) *zap.Logger {
+	encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	core := zapcore.NewCore(encoder, zapcore.AddSync(buf), zapcore.DebugLevel)
+	return zap.New(core)
+}
+
 var (
 	errExpected   = errors.New("expected error")
 	errUnexpected = errors.New("unexpected error")
@@ -46,13 +59,13 @@ func TestContinuousQueryService_Run(t *testing.T) {
 
 	done := make(chan struct{})
 	expectCallCnt := 3
-	callCnt := 0
+	var callCnt int64
 
-	// Set a callback for ExecuteQuery.
+	// Set a callback for ExecuteQuery. CQs run concurrently, so the counter
+	// must be updated atomically.
 	qe := s.QueryExecutor.(*QueryExecutor)
 	qe.ExecuteQueryFn = func(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error) {
-		callCnt++
-		if callCnt >= expectCallCnt {
+		if atomic.AddInt64(&callCnt, 1) >= int64(expectCallCnt) {
 			done <- struct{}{}
 		}
 		dummych := make(chan *influxql.Result, 1)
@@ -79,7 +92,7 @@ func TestContinuousQueryService_Run(t *testing.T) {
 
 	// Now test just one query.
 	expectCallCnt = 1
-	callCnt = 0
+	atomic.StoreInt64(&callCnt, 0)
 	s.Open()
 	s.Run("db", "cq", now)
 	// Shouldn't time out.
@@ -335,10 +348,11 @@ func NewTestService(t *testing.T) *Service {
 	s.QueryExecutor = NewQueryExecutor(t)
 	s.RunInterval = time.Millisecond
 
-	// Set Logger to write to dev/null so stdout isn't polluted.
-	if !testing.Verbose() {
-		s.Logger = log.New(ioutil.Discard, "", log.LstdFlags)
-	}
+	// Logger writes structured JSON to a buffer instead of stdout so tests
+	// can assert on fields rather than substring-match log output.
+	s.Logger = NewTestLogger(&bytes.Buffer{})
+
+	s.Checkpointer = NewMockCheckpointer()
 
 	// Add a couple test databases and CQs.
 	ms.CreateDatabase("db", "rp")
@@ -360,6 +374,10 @@ type MetaClient struct {
 	Err           error
 	t             *testing.T
 	nodeID        uint64
+
+	// LogEnabledOverrides holds per-CQ LogEnabled overrides, keyed by
+	// "db/cqName", for tests exercising ContinuousQueryLogEnabled.
+	LogEnabledOverrides map[string]bool
 }
 
 // NewMetaClient returns a *MetaClient.
@@ -375,6 +393,20 @@ func NewMetaClient(t *testing.T) *MetaClient {
 // NodeID returns the client's node ID.
 func (ms *MetaClient) NodeID() uint64 { return ms.nodeID }
 
+// ContinuousQueryLogEnabled implements the optional per-CQ LogEnabled
+// override that Service.cqLogEnabled type-asserts for. It returns an error
+// when no override has been configured for db/cqName, so callers fall back
+// to Config.LogEnabled.
+func (ms *MetaClient) ContinuousQueryLogEnabled(db, cqName string) (bool, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	enabled, ok := ms.LogEnabledOverrides[db+"/"+cqName]
+	if !ok {
+		return false, errors.New("no LogEnabled override configured")
+	}
+	return enabled, nil
+}
+
 // AcquireLease attempts to acquire the specified lease.
 func (ms *MetaClient) AcquireLease(name string) (l *meta.Lease, err error) {
 	if ms.Leader {
@@ -467,6 +499,579 @@ func (ms *MetaClient) CreateContinuousQuery(database, name, query string) error
 	return nil
 }
 
+// TestService_Hooks_DeliveredOnce verifies that a successful CQ run
+// delivers exactly one BeforeRun, one OnWrite, and one AfterRun event.
+func TestService_Hooks_DeliveredOnce(t *testing.T) {
+	s := NewTestService(t)
+
+	var before, after, writes int
+	defer s.Subscribe(BeforeRun, func(CQEvent) { before++ })()
+	defer s.Subscribe(AfterRun, func(CQEvent) { after++ })()
+	defer s.Subscribe(OnWrite, func(CQEvent) { writes++ })()
+
+	dbis, _ := s.MetaClient.Databases()
+	dbi := dbis[0]
+	cqi := dbi.ContinuousQueries[0]
+
+	now := time.Now().Truncate(10 * time.Minute)
+	if err := s.ExecuteContinuousQuery(&dbi, &cqi, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if before != 1 {
+		t.Errorf("expected exactly one BeforeRun event, got %d", before)
+	}
+	if after != 1 {
+		t.Errorf("expected exactly one AfterRun event, got %d", after)
+	}
+	if writes != 1 {
+		t.Errorf("expected exactly one OnWrite event, got %d", writes)
+	}
+}
+
+// TestService_Hooks_NotLeader verifies that an OnSkip event with
+// SkipNotLeader fires when this node isn't the cluster leader.
+func TestService_Hooks_NotLeader(t *testing.T) {
+	s := NewTestService(t)
+	s.RunInterval = 10 * time.Second
+	s.MetaClient.(*MetaClient).Leader = false
+
+	// One OnSkip fires per CQ, and NewTestService creates three, so the
+	// channel holds them all and the hook never blocks the run.
+	skipped := make(chan CQEvent, 3)
+	defer s.Subscribe(OnSkip, func(ev CQEvent) { skipped <- ev })()
+
+	s.Open()
+	defer s.Close()
+	s.RunCh <- &RunRequest{Now: time.Now()}
+
+	select {
+	case ev := <-skipped:
+		if ev.SkipReason != SkipNotLeader {
+			t.Errorf("expected SkipNotLeader, got %v", ev.SkipReason)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("expected an OnSkip event")
+	}
+}
+
+// TestService_Hooks_MetaError verifies that an OnSkip event with
+// SkipMetaError fires when the meta store can't be queried.
+func TestService_Hooks_MetaError(t *testing.T) {
+	s := NewTestService(t)
+	s.RunInterval = 10 * time.Second
+	s.MetaClient.(*MetaClient).Err = errExpected
+
+	skipped := make(chan CQEvent, 1)
+	defer s.Subscribe(OnSkip, func(ev CQEvent) { skipped <- ev })()
+
+	s.Open()
+	defer s.Close()
+	s.RunCh <- &RunRequest{Now: time.Now()}
+
+	select {
+	case ev := <-skipped:
+		if ev.SkipReason != SkipMetaError {
+			t.Errorf("expected SkipMetaError, got %v", ev.SkipReason)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("expected an OnSkip event")
+	}
+}
+
+// TestContinuousQueryService_Backpressure verifies that once
+// MaxConcurrentQueries is exhausted, further CQ runs are shed (rather than
+// executed) when BackpressurePolicy is "shed", and that the shed runs are
+// reflected in the service's statistics.
+func TestContinuousQueryService_Backpressure(t *testing.T) {
+	cfg := NewConfig()
+	cfg.MaxConcurrentQueries = 1
+	cfg.BackpressurePolicy = BackpressureShed
+
+	s := NewService(cfg)
+	ms := NewMetaClient(t)
+	s.MetaClient = ms
+	s.RunInterval = time.Millisecond
+	s.Logger = NewTestLogger(&bytes.Buffer{})
+
+	ms.CreateDatabase("db", "rp")
+	ms.CreateContinuousQuery("db", "cq", `CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT count(cpu) INTO cpu_count FROM cpu WHERE time > now() - 1h GROUP BY time(1s) END`)
+	ms.CreateDatabase("db2", "rp")
+	ms.CreateContinuousQuery("db2", "cq2", `CREATE CONTINUOUS QUERY cq2 ON db2 BEGIN SELECT count(cpu) INTO cpu_count FROM cpu WHERE time > now() - 1h GROUP BY time(1s) END`)
+
+	qe := NewQueryExecutor(t)
+	s.QueryExecutor = qe
+
+	// Block the first query in flight so the second one, queued while the
+	// first holds the only concurrency slot, gets shed.
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	qe.ExecuteQueryFn = func(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error) {
+		entered <- struct{}{}
+		<-release
+		dummych := make(chan *influxql.Result, 1)
+		dummych <- &influxql.Result{}
+		return dummych, nil
+	}
+
+	now := time.Now().Truncate(10 * time.Minute)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dbi, _ := s.MetaClient.Database("db")
+		cqi := dbi.ContinuousQueries[0]
+		check(s.ExecuteContinuousQuery(dbi, &cqi, now))
+	}()
+
+	if err := wait(entered, 100*time.Millisecond); err != nil {
+		t.Fatal("first query never started")
+	}
+
+	dbi2, _ := s.MetaClient.Database("db2")
+	cqi2 := dbi2.ContinuousQueries[0]
+	if err := s.ExecuteContinuousQuery(dbi2, &cqi2, now); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	stats := s.Statistics(nil)[0].Values
+	if skipped := stats["queriesSkipped"].(int64); skipped < 1 {
+		t.Errorf("expected at least one skipped query, got %d", skipped)
+	}
+}
+
+// TestExecuteContinuousQuery_MaxPointsPerSecond verifies that
+// Config.MaxPointsPerSecond throttles a run that writes more points than the
+// configured rate, and that the wait is reflected in the writeWaitNs stat.
+func TestExecuteContinuousQuery_MaxPointsPerSecond(t *testing.T) {
+	cfg := NewConfig()
+	cfg.MaxPointsPerSecond = 10
+
+	s := NewService(cfg)
+	ms := NewMetaClient(t)
+	s.MetaClient = ms
+	s.Logger = NewTestLogger(&bytes.Buffer{})
+
+	ms.CreateDatabase("db", "rp")
+	ms.CreateContinuousQuery("db", "cq", `CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT count(cpu) INTO cpu_count FROM cpu WHERE time > now() - 1h GROUP BY time(1s) END`)
+
+	qe := NewQueryExecutor(t)
+	// 11 points at a rate/burst of 10/s: the first 10 drain the bucket
+	// instantly, leaving the 11th to wait out a refill.
+	qe.Results = []*influxql.Result{genResult(1, 11)}
+	s.QueryExecutor = qe
+
+	dbi, err := s.MetaClient.Database("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cqi := dbi.ContinuousQueries[0]
+
+	if err := s.ExecuteContinuousQuery(dbi, &cqi, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if waitNs := s.Statistics(nil)[0].Values["writeWaitNs"].(int64); waitNs <= 0 {
+		t.Errorf("expected MaxPointsPerSecond to record a non-zero writeWaitNs, got %d", waitNs)
+	}
+}
+
+// TestExecuteContinuousQuery_QueryTimeout verifies that Config.QueryTimeout
+// closes the closing channel passed to QueryExecutor.ExecuteQuery once the
+// timeout elapses, even while the query is still running.
+func TestExecuteContinuousQuery_QueryTimeout(t *testing.T) {
+	s := NewTestService(t)
+	s.queryTimeout = 50 * time.Millisecond
+
+	qe := NewQueryExecutor(t)
+	cancelled := make(chan struct{})
+	qe.ExecuteQueryFn = func(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error) {
+		select {
+		case <-closing:
+			close(cancelled)
+		case <-time.After(time.Second):
+		}
+		return nil, errExpected
+	}
+	s.QueryExecutor = qe
+
+	dbis, _ := s.MetaClient.Databases()
+	dbi := dbis[0]
+	cqi := dbi.ContinuousQueries[0]
+
+	if err := s.ExecuteContinuousQuery(&dbi, &cqi, time.Now()); err != errExpected {
+		t.Fatalf("exp = %v, got = %v", errExpected, err)
+	}
+
+	if err := wait(cancelled, 200*time.Millisecond); err != nil {
+		t.Error("expected QueryTimeout to close the closing channel while the query was still running")
+	}
+}
+
+// TestService_Hooks_AfterRunSuppressedWhenAllWindowsShed verifies that
+// AfterRun does not fire for a run in which every window was shed by
+// backpressure, since in that case no window actually executed.
+func TestService_Hooks_AfterRunSuppressedWhenAllWindowsShed(t *testing.T) {
+	cfg := NewConfig()
+	cfg.MaxConcurrentQueries = 1
+	cfg.BackpressurePolicy = BackpressureShed
+
+	s := NewService(cfg)
+	ms := NewMetaClient(t)
+	s.MetaClient = ms
+	s.Logger = NewTestLogger(&bytes.Buffer{})
+
+	ms.CreateDatabase("db", "rp")
+	ms.CreateContinuousQuery("db", "cq", `CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT count(cpu) INTO cpu_count FROM cpu WHERE time > now() - 1h GROUP BY time(1s) END`)
+	ms.CreateDatabase("db2", "rp")
+	ms.CreateContinuousQuery("db2", "cq2", `CREATE CONTINUOUS QUERY cq2 ON db2 BEGIN SELECT count(cpu) INTO cpu_count FROM cpu WHERE time > now() - 1h GROUP BY time(1s) END`)
+
+	qe := NewQueryExecutor(t)
+	s.QueryExecutor = qe
+
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	qe.ExecuteQueryFn = func(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error) {
+		entered <- struct{}{}
+		<-release
+		dummych := make(chan *influxql.Result, 1)
+		dummych <- &influxql.Result{}
+		return dummych, nil
+	}
+
+	var before, after, writes int32
+	defer s.Subscribe(BeforeRun, func(CQEvent) { atomic.AddInt32(&before, 1) })()
+	defer s.Subscribe(AfterRun, func(CQEvent) { atomic.AddInt32(&after, 1) })()
+	defer s.Subscribe(OnWrite, func(CQEvent) { atomic.AddInt32(&writes, 1) })()
+
+	now := time.Now().Truncate(10 * time.Minute)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dbi, _ := s.MetaClient.Database("db")
+		cqi := dbi.ContinuousQueries[0]
+		check(s.ExecuteContinuousQuery(dbi, &cqi, now))
+	}()
+
+	if err := wait(entered, 100*time.Millisecond); err != nil {
+		t.Fatal("first query never started")
+	}
+
+	dbi2, _ := s.MetaClient.Database("db2")
+	cqi2 := dbi2.ContinuousQueries[0]
+	if err := s.ExecuteContinuousQuery(dbi2, &cqi2, now); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(&before) != 2 {
+		t.Errorf("expected BeforeRun to fire for both runs, got %d", before)
+	}
+	if atomic.LoadInt32(&writes) != 1 {
+		t.Errorf("expected exactly one OnWrite event, got %d", writes)
+	}
+	if atomic.LoadInt32(&after) != 1 {
+		t.Errorf("expected AfterRun to fire only for the run that actually executed, got %d", after)
+	}
+}
+
+// TestExecuteContinuousQuery_StructuredLogging verifies that a successful
+// run emits a single structured log line carrying the documented fields.
+func TestExecuteContinuousQuery_StructuredLogging(t *testing.T) {
+	s := NewTestService(t)
+
+	var buf bytes.Buffer
+	s.Logger = NewTestLogger(&buf)
+
+	dbis, _ := s.MetaClient.Databases()
+	dbi := dbis[0]
+	cqi := dbi.ContinuousQueries[0]
+
+	now := time.Now().Truncate(10 * time.Minute)
+	if err := s.ExecuteContinuousQuery(&dbi, &cqi, now); err != nil {
+		t.Fatal(err)
+	}
+
+	line := strings.TrimSpace(buf.String())
+	if line == "" {
+		t.Fatal("expected a log line to be emitted")
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.SplitN(line, "\n", 2)[0]), &fields); err != nil {
+		t.Fatalf("log line was not valid JSON: %v", err)
+	}
+
+	for _, key := range []string{"database", "cq_name", "now", "window_start", "window_end", "resample_every", "resample_for", "points_written", "duration_ms"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("expected log line to contain field %q, got %v", key, fields)
+		}
+	}
+}
+
+// TestExecuteContinuousQuery_LogEnabledOverride verifies that a per-CQ
+// LogEnabled override read from the meta store wins over Config.LogEnabled.
+func TestExecuteContinuousQuery_LogEnabledOverride(t *testing.T) {
+	cfg := NewConfig()
+	cfg.LogEnabled = false
+
+	s := NewService(cfg)
+	ms := NewMetaClient(t)
+	ms.LogEnabledOverrides = map[string]bool{"db/cq": true}
+	s.MetaClient = ms
+	s.QueryExecutor = NewQueryExecutor(t)
+
+	var buf bytes.Buffer
+	s.Logger = NewTestLogger(&buf)
+
+	ms.CreateDatabase("db", "rp")
+	ms.CreateContinuousQuery("db", "cq", `CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT count(cpu) INTO cpu_count FROM cpu WHERE time > now() - 1h GROUP BY time(1s) END`)
+
+	dbi, err := s.MetaClient.Database("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cqi := dbi.ContinuousQueries[0]
+
+	if err := s.ExecuteContinuousQuery(dbi, &cqi, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "finished continuous query") {
+		t.Error("expected the per-CQ LogEnabled override to win over Config.LogEnabled=false")
+	}
+}
+
+// MockCheckpointer is an in-memory mock Checkpointer.
+type MockCheckpointer struct {
+	mu     sync.Mutex
+	states map[string]CQState
+	SaveFn func(db, cqName string, state CQState) error
+}
+
+// NewMockCheckpointer returns a *MockCheckpointer.
+func NewMockCheckpointer() *MockCheckpointer {
+	return &MockCheckpointer{states: make(map[string]CQState)}
+}
+
+// Save implements Checkpointer.
+func (c *MockCheckpointer) Save(db, cqName string, state CQState) error {
+	if c.SaveFn != nil {
+		if err := c.SaveFn(db, cqName, state); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states[db+"/"+cqName] = state
+	return nil
+}
+
+// Load implements Checkpointer.
+func (c *MockCheckpointer) Load(db, cqName string) (CQState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.states[db+"/"+cqName], nil
+}
+
+// TestExecuteContinuousQuery_Checkpoints verifies that a successful
+// execution leaves behind a checkpoint marked complete for the window that
+// was run.
+func TestExecuteContinuousQuery_Checkpoints(t *testing.T) {
+	s := NewTestService(t)
+	mc := NewMockCheckpointer()
+	s.Checkpointer = mc
+
+	dbis, _ := s.MetaClient.Databases()
+	dbi := dbis[0]
+	cqi := dbi.ContinuousQueries[0]
+
+	now := time.Now().Truncate(10 * time.Minute)
+	if err := s.ExecuteContinuousQuery(&dbi, &cqi, now); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := mc.Load(dbi.Name, cqi.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Complete {
+		t.Error("expected checkpoint to be marked complete after a successful run")
+	}
+	if state.WindowEnd.IsZero() {
+		t.Error("expected checkpoint to record a window end time")
+	}
+}
+
+// TestExecuteContinuousQuery_CheckpointIntervalHonoredAcrossRuns verifies
+// that the pre-execution checkpoint write is throttled by
+// Config.CheckpointInterval across separate ExecuteContinuousQuery calls,
+// rather than being reset to "always due" at the start of every call.
+func TestExecuteContinuousQuery_CheckpointIntervalHonoredAcrossRuns(t *testing.T) {
+	s := NewTestService(t)
+	mc := NewMockCheckpointer()
+	s.Checkpointer = mc
+	s.CheckpointInterval = 30 * time.Second
+
+	ms := NewMetaClient(t)
+	ms.CreateDatabase("db", "rp")
+	ms.CreateContinuousQuery("db", "cq", `CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT count(cpu) INTO cpu_count FROM cpu WHERE time > now() - 1h GROUP BY time(1s) END`)
+	s.MetaClient = ms
+
+	var pendingSaves int32
+	mc.SaveFn = func(db, cqName string, state CQState) error {
+		if !state.Complete {
+			atomic.AddInt32(&pendingSaves, 1)
+		}
+		return nil
+	}
+
+	dbi, err := s.MetaClient.Database("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cqi := dbi.ContinuousQueries[0]
+
+	// Two runs in quick succession, each covering a different window. Both
+	// are well within the 30s CheckpointInterval of each other.
+	now := time.Now().Truncate(time.Second)
+	if err := s.ExecuteContinuousQuery(dbi, &cqi, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExecuteContinuousQuery(dbi, &cqi, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&pendingSaves); n != 1 {
+		t.Errorf("expected exactly one pre-execution checkpoint save within the checkpoint interval, got %d", n)
+	}
+}
+
+// TestService_ResumesIncompleteCheckpoint verifies that a checkpoint left
+// behind in an incomplete state is re-issued the next time the service
+// opens, rather than silently dropped.
+func TestService_ResumesIncompleteCheckpoint(t *testing.T) {
+	s := NewTestService(t)
+	mc := NewMockCheckpointer()
+	s.Checkpointer = mc
+
+	dbis, _ := s.MetaClient.Databases()
+	dbi := dbis[0]
+	cqi := dbi.ContinuousQueries[0]
+
+	windowEnd := time.Now().Truncate(10 * time.Minute)
+	check(mc.Save(dbi.Name, cqi.Name, CQState{
+		WindowStart: windowEnd.Add(-time.Second),
+		WindowEnd:   windowEnd,
+		Complete:    false,
+	}))
+
+	done := make(chan struct{})
+	qe := s.QueryExecutor.(*QueryExecutor)
+	qe.ExecuteQueryFn = func(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error) {
+		done <- struct{}{}
+		dummych := make(chan *influxql.Result, 1)
+		dummych <- &influxql.Result{}
+		return dummych, nil
+	}
+
+	s.RunInterval = 10 * time.Minute
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := wait(done, 100*time.Millisecond); err != nil {
+		t.Error("expected incomplete checkpoint to be resumed on Open")
+	}
+}
+
+// TestService_ResumesOnlyIncompleteWindow verifies that resuming a
+// checkpoint left behind mid-run re-issues only the single window recorded
+// in the checkpoint, not the whole RESAMPLE FOR range for that window's
+// anchor -- earlier windows in that range already completed and must not be
+// re-executed.
+func TestService_ResumesOnlyIncompleteWindow(t *testing.T) {
+	s := NewTestService(t)
+	mc := NewMockCheckpointer()
+	s.Checkpointer = mc
+
+	mc2 := NewMetaClient(t)
+	mc2.CreateDatabase("db", "rp")
+	mc2.CreateContinuousQuery("db", "cq", `CREATE CONTINUOUS QUERY cq ON db RESAMPLE EVERY 1m FOR 3m BEGIN SELECT mean(value) INTO cpu_mean FROM cpu GROUP BY time(1m) END`)
+	s.MetaClient = mc2
+
+	dbi, err := s.MetaClient.Database("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cqi := dbi.ContinuousQueries[0]
+
+	// Simulate a crash partway through a 3-window run: the earliest window
+	// already completed, and the checkpoint for the next one was written
+	// (but never marked complete) before the process died.
+	anchor := time.Now().Truncate(time.Minute)
+	check(mc.Save(dbi.Name, cqi.Name, CQState{
+		WindowStart: anchor.Add(-3 * time.Minute),
+		WindowEnd:   anchor.Add(-2 * time.Minute),
+		Complete:    true,
+	}))
+	incompleteStart := anchor.Add(-2 * time.Minute)
+	incompleteEnd := anchor.Add(-1 * time.Minute)
+	check(mc.Save(dbi.Name, cqi.Name, CQState{
+		WindowStart: incompleteStart,
+		WindowEnd:   incompleteEnd,
+		Complete:    false,
+	}))
+
+	var mu sync.Mutex
+	var executed []time.Time
+	qe := s.QueryExecutor.(*QueryExecutor)
+	qe.ExecuteQueryFn = func(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error) {
+		mu.Lock()
+		executed = append(executed, time.Now())
+		mu.Unlock()
+		dummych := make(chan *influxql.Result, 1)
+		dummych <- &influxql.Result{}
+		return dummych, nil
+	}
+
+	s.RunInterval = 10 * time.Minute
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	n := len(executed)
+	mu.Unlock()
+	if n != 1 {
+		t.Errorf("expected exactly one window to be resumed, got %d", n)
+	}
+
+	state, err := mc.Load(dbi.Name, cqi.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.WindowStart.Equal(incompleteStart) || !state.WindowEnd.Equal(incompleteEnd) {
+		t.Errorf("expected resumed checkpoint to cover %s-%s, got %s-%s",
+			incompleteStart, incompleteEnd, state.WindowStart, state.WindowEnd)
+	}
+	if !state.Complete {
+		t.Error("expected resumed window's checkpoint to be marked complete")
+	}
+}
+
 // QueryExecutor is a mock query executor.
 type QueryExecutor struct {
 	ExecuteQueryFn func(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error)
@@ -474,6 +1079,7 @@ type QueryExecutor struct {
 	ResultInterval time.Duration
 	Err            error
 	ErrAfterResult int
+	Logger         *zap.Logger
 	t              *testing.T
 }
 
@@ -481,16 +1087,20 @@ type QueryExecutor struct {
 func NewQueryExecutor(t *testing.T) *QueryExecutor {
 	return &QueryExecutor{
 		ErrAfterResult: -1,
+		Logger:         NewTestLogger(&bytes.Buffer{}),
 		t:              t,
 	}
 }
 
 // ExecuteQuery returns a channel that the caller can read query results from.
 func (qe *QueryExecutor) ExecuteQuery(query *influxql.Query, database string, chunkSize int, closing chan struct{}) (<-chan *influxql.Result, error) {
+	qe.Logger.Debug("executing query", zap.String("database", database))
 
-	// If the test set a callback, call it.
+	// If the test set a callback, call it. closing is passed through
+	// unmodified so a test can assert that it gets closed (e.g. by
+	// Config.QueryTimeout) while a query is in flight.
 	if qe.ExecuteQueryFn != nil {
-		if _, err := qe.ExecuteQueryFn(query, database, chunkSize, make(chan struct{})); err != nil {
+		if _, err := qe.ExecuteQueryFn(query, database, chunkSize, closing); err != nil {
 			return nil, err
 		}
 	}